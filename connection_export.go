@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	log "github.com/sirupsen/logrus"
+)
+
+const rawExportSeparator = "\n==============================\n"
+
+// syntheticISN is the initial sequence number used for both sides of a reconstructed pcap: the dissector has no
+// way to recover the original capture's sequence numbers (they aren't part of ConnectionStream), so the export
+// is a synthetic-but-valid TCP stream rather than a byte-for-byte replay of the original capture.
+const syntheticISN = 1
+
+// clientMAC/serverMAC are placeholder, locally-administered hardware addresses used to fill in the Ethernet
+// layer of a synthetic pcap: ConnectionStream doesn't retain the original capture's MAC addresses, but
+// gopacket's Ethernet.SerializeTo rejects any layer whose SrcMAC/DstMAC isn't exactly 6 bytes, so the layer
+// must carry something.
+var (
+	clientMAC = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	serverMAC = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x02}
+)
+
+// ExportConnection renders the ordered payloads of a connection into a format consumable by other tools,
+// selected via format.Format: "pcap" for a synthetic capture with reconstructed TCP segments, "har" for an HTTP
+// Archive (only meaningful when the HTTP dissector matches), "curl" for a reproducer script of the client-side
+// requests, or "raw" for tshark's follow/raw layout (client bytes, then server bytes). Every format streams
+// straight to the response writer as payloads are read, rather than buffering the whole conversation first.
+func (csc ConnectionStreamsController) ExportConnection(ginContext *gin.Context, connectionID RowID,
+	srcIP, dstIP net.IP, srcPort, dstPort uint16, format QueryFormat) {
+	c := ginContext.Request.Context()
+	w := ginContext.Writer
+
+	switch format.Format {
+	case "pcap":
+		w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%v.pcap"`, connectionID))
+		csc.exportPCAP(c, w, connectionID, srcIP, dstIP, srcPort, dstPort)
+	case "har":
+		w.Header().Set("Content-Type", "application/json")
+		csc.exportHAR(c, w, connectionID)
+	case "curl":
+		w.Header().Set("Content-Type", "text/x-shellscript")
+		csc.exportCurl(c, w, connectionID, dstIP, dstPort)
+	case "raw":
+		w.Header().Set("Content-Type", "application/octet-stream")
+		csc.exportRaw(c, w, connectionID)
+	default:
+		ginContext.AbortWithStatusJSON(http.StatusBadRequest,
+			gin.H{"error": "unsupported export format: " + format.Format})
+	}
+}
+
+// rawBlock is one BlocksIndexes entry of a ConnectionStream, resolved to its byte slice.
+type rawBlock struct {
+	fromClient bool
+	data       []byte
+	timestamp  time.Time
+	loss       bool
+}
+
+// walkRawBlocks merges the client and server ConnectionStreams of a connection in timestamp order, like
+// iterateConnectionPayloadFrom, but yields the raw undecoded bytes of each block instead of a display-formatted
+// Payload. Export formats need the original bytes (pcap, har) or per-side ordering regardless of time (raw), not
+// the QueryFormat.Format-decoded string used for the JSON payload API.
+func (csc ConnectionStreamsController) walkRawBlocks(c context.Context, connectionID RowID, emit func(rawBlock) bool) {
+	var clientBlocksIndex, serverBlocksIndex, clientDocumentIndex, serverDocumentIndex int
+	clientStream := csc.getConnectionStream(c, connectionID, true, clientDocumentIndex)
+	serverStream := csc.getConnectionStream(c, connectionID, false, serverDocumentIndex)
+
+	hasClientBlocks := func() bool { return clientBlocksIndex < len(clientStream.BlocksIndexes) }
+	hasServerBlocks := func() bool { return serverBlocksIndex < len(serverStream.BlocksIndexes) }
+
+	blockRange := func(stream ConnectionStream, blockIndex int) (int, int) {
+		start := stream.BlocksIndexes[blockIndex]
+		if blockIndex < len(stream.BlocksIndexes)-1 {
+			return start, stream.BlocksIndexes[blockIndex+1]
+		}
+		return start, len(stream.Payload)
+	}
+
+	for !clientStream.ID.IsZero() || !serverStream.ID.IsZero() {
+		var block rawBlock
+		if hasClientBlocks() && (!hasServerBlocks() ||
+			clientStream.BlocksTimestamps[clientBlocksIndex].UnixNano() <=
+				serverStream.BlocksTimestamps[serverBlocksIndex].UnixNano()) {
+			start, end := blockRange(clientStream, clientBlocksIndex)
+			block = rawBlock{
+				fromClient: true,
+				data:       clientStream.Payload[start:end],
+				timestamp:  clientStream.BlocksTimestamps[clientBlocksIndex],
+				loss:       clientStream.BlocksLoss[clientBlocksIndex],
+			}
+			clientBlocksIndex++
+		} else {
+			start, end := blockRange(serverStream, serverBlocksIndex)
+			block = rawBlock{
+				fromClient: false,
+				data:       serverStream.Payload[start:end],
+				timestamp:  serverStream.BlocksTimestamps[serverBlocksIndex],
+				loss:       serverStream.BlocksLoss[serverBlocksIndex],
+			}
+			serverBlocksIndex++
+		}
+
+		if !hasClientBlocks() {
+			clientDocumentIndex++
+			clientBlocksIndex = 0
+			clientStream = csc.getConnectionStream(c, connectionID, true, clientDocumentIndex)
+		}
+		if !hasServerBlocks() {
+			serverDocumentIndex++
+			serverBlocksIndex = 0
+			serverStream = csc.getConnectionStream(c, connectionID, false, serverDocumentIndex)
+		}
+
+		if !emit(block) {
+			return
+		}
+	}
+}
+
+// coalescedBlock is a run of one or more consecutive same-direction rawBlocks merged into a single byte slice,
+// timestamped at the start of the run.
+type coalescedBlock struct {
+	fromClient bool
+	data       []byte
+	timestamp  time.Time
+}
+
+// walkCoalescedBlocks wraps walkRawBlocks, merging consecutive same-direction blocks into one coalescedBlock
+// before calling emit, the same way iterateConnectionPayloadFrom buffers a side-run into contentChunkBuffer
+// before dissecting it. walkRawBlocks yields raw blocks one TCP segment at a time; a dissector that needs to see
+// a whole unit (e.g. an HTTP/2 HEADERS frame split across segments) fails to parse one segment on its own, so
+// callers that dissect the bytes (exportHAR, exportCurl) need this instead of walkRawBlocks directly. exportPCAP
+// still uses walkRawBlocks untouched, since a synthetic pcap needs one packet per real segment.
+func (csc ConnectionStreamsController) walkCoalescedBlocks(c context.Context, connectionID RowID,
+	emit func(coalescedBlock) bool) {
+	var buffer bytes.Buffer
+	var bufferedSide bool
+	var bufferedTimestamp time.Time
+	hasBuffered := false
+
+	flush := func() bool {
+		if !hasBuffered {
+			return true
+		}
+		ok := emit(coalescedBlock{fromClient: bufferedSide, data: append([]byte(nil), buffer.Bytes()...),
+			timestamp: bufferedTimestamp})
+		buffer.Reset()
+		hasBuffered = false
+		return ok
+	}
+
+	aborted := false
+	csc.walkRawBlocks(c, connectionID, func(block rawBlock) bool {
+		if hasBuffered && block.fromClient != bufferedSide {
+			if !flush() {
+				aborted = true
+				return false
+			}
+		}
+		if !hasBuffered {
+			bufferedSide, bufferedTimestamp, hasBuffered = block.fromClient, block.timestamp, true
+		}
+		buffer.Write(block.data)
+		return true
+	})
+	if !aborted {
+		flush()
+	}
+}
+
+// exportRaw writes every client byte followed by every server byte, each separated by rawExportSeparator,
+// mirroring tshark's "Follow TCP Stream > raw" output. Unlike the other export formats this doesn't need
+// timestamp-ordered interleaving, so it walks each side's documents directly instead of through walkRawBlocks.
+func (csc ConnectionStreamsController) exportRaw(c context.Context, w io.Writer, connectionID RowID) {
+	writeSide := func(fromClient bool) {
+		for documentIndex := 0; ; documentIndex++ {
+			stream := csc.getConnectionStream(c, connectionID, fromClient, documentIndex)
+			if stream.ID.IsZero() {
+				return
+			}
+			if _, err := w.Write(stream.Payload); err != nil {
+				return
+			}
+		}
+	}
+
+	writeSide(true)
+	io.WriteString(w, rawExportSeparator)
+	writeSide(false)
+}
+
+// exportPCAP reconstructs a synthetic capture of the connection: one Ethernet+IPv4+TCP packet per block, with
+// sequence numbers derived from the cumulative bytes already sent on each side rather than recovered from the
+// original capture (ConnectionStream doesn't retain them).
+func (csc ConnectionStreamsController) exportPCAP(c context.Context, w io.Writer, connectionID RowID,
+	srcIP, dstIP net.IP, srcPort, dstPort uint16) {
+	pcapWriter := pcapgo.NewWriter(w)
+	if err := pcapWriter.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+		log.WithError(err).Error("failed to write pcap file header")
+		return
+	}
+
+	var clientSeq, serverSeq uint32 = syntheticISN, syntheticISN
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}
+
+	var exportErr error
+	csc.walkRawBlocks(c, connectionID, func(block rawBlock) bool {
+		eth := &layers.Ethernet{EthernetType: layers.EthernetTypeIPv4}
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP}
+		tcp := &layers.TCP{PSH: true, ACK: true, Window: 65535}
+
+		if block.fromClient {
+			eth.SrcMAC, eth.DstMAC = clientMAC, serverMAC
+			ip.SrcIP, ip.DstIP = srcIP, dstIP
+			tcp.SrcPort, tcp.DstPort = layers.TCPPort(srcPort), layers.TCPPort(dstPort)
+			tcp.Seq = clientSeq
+			clientSeq += uint32(len(block.data))
+		} else {
+			eth.SrcMAC, eth.DstMAC = serverMAC, clientMAC
+			ip.SrcIP, ip.DstIP = dstIP, srcIP
+			tcp.SrcPort, tcp.DstPort = layers.TCPPort(dstPort), layers.TCPPort(srcPort)
+			tcp.Seq = serverSeq
+			serverSeq += uint32(len(block.data))
+		}
+		if err := tcp.SetNetworkLayerForChecksum(ip); err != nil {
+			exportErr = fmt.Errorf("failed to set pcap network layer for checksum: %w", err)
+			return false
+		}
+
+		buffer.Clear()
+		payload := gopacket.Payload(block.data)
+		if err := gopacket.SerializeLayers(buffer, options, eth, ip, tcp, payload); err != nil {
+			exportErr = fmt.Errorf("failed to serialize a synthetic pcap packet: %w", err)
+			return false
+		}
+
+		captureInfo := gopacket.CaptureInfo{Timestamp: block.timestamp, CaptureLength: len(buffer.Bytes()),
+			Length: len(buffer.Bytes())}
+		if err := pcapWriter.WritePacket(captureInfo, buffer.Bytes()); err != nil {
+			exportErr = fmt.Errorf("failed to write a synthetic pcap packet: %w", err)
+			return false
+		}
+		return true
+	})
+
+	if exportErr != nil {
+		// The pcap global header (and possibly some packets) is already on the wire by this point, so the
+		// response can't be turned into a clean error status anymore; log it loudly instead of letting the
+		// client believe a truncated capture is the whole connection.
+		log.WithError(exportErr).WithField("connection_id", connectionID).Error("pcap export aborted mid-stream")
+	}
+}
+
+// harEntry is the subset of the HAR 1.2 "entries" schema caronte can actually populate from a ConnectionStream:
+// a single request/response pair, with raw bytes for the body always and Method/URL/Status filled in only when
+// the HTTP/2 dissector (see dissectors.go) recognizes the block.
+type harEntry struct {
+	StartedDateTime time.Time  `json:"startedDateTime"`
+	Request         harMessage `json:"request"`
+	Response        harMessage `json:"response"`
+}
+
+type harMessage struct {
+	Method      string `json:"method,omitempty"`
+	URL         string `json:"url,omitempty"`
+	Status      int    `json:"status,omitempty"`
+	HTTPVersion string `json:"httpVersion"`
+	BodySize    int    `json:"bodySize"`
+	Content     string `json:"content"`
+}
+
+// http2PseudoHeaders pulls :method/:path (request side) or :status (response side) out of the first HEADERS
+// frame the HTTP/2 dissector decoded for a block, if any. connectionID/fromClient/walkID scope the call to the
+// right direction's HPACK dynamic table, same as the streaming/range payload paths; walkID must be the same
+// value for every call belonging to one export, and a different value than any concurrent or later export or
+// stream over the same connection, so this export's decoder is never shared with (and corrupted by) another walk.
+func http2PseudoHeaders(c context.Context, connectionID RowID, fromClient bool, walkID uint64,
+	data []byte) (method, path, status string) {
+	metadata := DissectContentChunk(c, dissectKey{connectionID: connectionID, fromClient: fromClient, walkID: walkID}, data, "http2")
+	if metadata.HTTP2 == nil {
+		return "", "", ""
+	}
+	for _, frame := range metadata.HTTP2.Frames {
+		if frame.Type != "HEADERS" {
+			continue
+		}
+		return frame.Headers[":method"], frame.Headers[":path"], frame.Headers[":status"]
+	}
+	return "", "", ""
+}
+
+// exportHAR streams a HAR 1.2 log whose entries pair up the client payload (request) with the following server
+// payload (response). Request/response bodies are always the raw bytes of the block; Method, URL and Status are
+// only populated when the HTTP/2 dissector matched the block, so connections using other protocols (or HTTP/1.1,
+// which isn't dissected by a structured parser here) still produce a structurally valid HAR, just without those
+// fields.
+func (csc ConnectionStreamsController) exportHAR(c context.Context, w io.Writer, connectionID RowID) {
+	io.WriteString(w, `{"log":{"version":"1.2","creator":{"name":"caronte","version":"1.0"},"entries":[`)
+
+	walkID := newWalkID()
+	encoder := json.NewEncoder(w)
+	// pending accumulates every client block seen since the last response, not just the most recent one: a
+	// request can span more than one coalesced client block (e.g. further client traffic arrives before the
+	// server replies), and keeping only the latest silently drops the earlier ones from the HAR entry.
+	var pending []coalescedBlock
+	first := true
+	flush := func(response coalescedBlock) {
+		if len(pending) == 0 {
+			return
+		}
+		var requestBody bytes.Buffer
+		for _, block := range pending {
+			requestBody.Write(block.data)
+		}
+		requestData := requestBody.Bytes()
+
+		method, path, _ := http2PseudoHeaders(c, connectionID, true, walkID, requestData)
+		_, _, status := http2PseudoHeaders(c, connectionID, false, walkID, response.data)
+		statusCode, _ := strconv.Atoi(status)
+
+		entry := harEntry{
+			StartedDateTime: pending[0].timestamp,
+			Request: harMessage{Method: method, URL: path, HTTPVersion: "HTTP/1.1",
+				BodySize: len(requestData), Content: string(requestData)},
+			Response: harMessage{Status: statusCode, HTTPVersion: "HTTP/1.1",
+				BodySize: len(response.data), Content: string(response.data)},
+		}
+		if !first {
+			io.WriteString(w, ",")
+		}
+		first = false
+		_ = encoder.Encode(entry)
+		pending = pending[:0]
+	}
+
+	csc.walkCoalescedBlocks(c, connectionID, func(block coalescedBlock) bool {
+		if block.fromClient {
+			pending = append(pending, block)
+		} else {
+			flush(block)
+		}
+		return true
+	})
+
+	io.WriteString(w, "]}}")
+}
+
+// exportCurl writes a shell script that replays every client-side block of the connection as a curl invocation
+// against dstIP:dstPort. When the HTTP/2 dissector recognizes the block, its pseudo-headers give a real method
+// and path and only the DATA frame payload (via HTTP2DataPayload) is sent as the body, so the target sees an
+// equivalent request rather than the raw capture stuffed in as curl's own body. Otherwise it falls back to
+// shipping the raw captured bytes as --data-binary, which isn't a real replay but is the best effort possible
+// without a parsed request line.
+func (csc ConnectionStreamsController) exportCurl(c context.Context, w io.Writer, connectionID RowID,
+	dstIP net.IP, dstPort uint16) {
+	io.WriteString(w, "#!/bin/sh\n# reconstructed from caronte connection "+connectionID.String()+"\n\n")
+
+	target := fmt.Sprintf("%s:%d", dstIP, dstPort)
+	walkID := newWalkID()
+	index := 0
+	csc.walkCoalescedBlocks(c, connectionID, func(block coalescedBlock) bool {
+		if !block.fromClient {
+			return true
+		}
+		index++
+
+		method, path, _ := http2PseudoHeaders(c, connectionID, true, walkID, block.data)
+		if method == "" {
+			fmt.Fprintf(w, "curl --include --raw --data-binary @- %s <<'EOF_%d'\n%s\nEOF_%d\n\n",
+				target, index, block.data, index)
+			return true
+		}
+
+		body := HTTP2DataPayload(block.data)
+		fmt.Fprintf(w, "curl --include --raw -X %s '%s%s'", method, target, path)
+		if len(body) == 0 {
+			io.WriteString(w, "\n\n")
+			return true
+		}
+		fmt.Fprintf(w, " --data-binary @- <<'EOF_%d'\n%s\nEOF_%d\n\n", index, body, index)
+		return true
+	})
+}
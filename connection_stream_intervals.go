@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ConnectionStreamCheckpoints is the collection that persists, for a connection, the merge-loop state
+// (document/block indexes on both sides) at the globalIndex where a document boundary was crossed. It lets
+// GetConnectionPayloadRange resume the merge loop close to a requested range instead of always replaying it
+// from document 0 on both sides.
+const ConnectionStreamCheckpoints = "connection_stream_checkpoints"
+
+// ConnectionStreamCheckpoint is a single resume point of the client/server merge loop in
+// ConnectionStreamsController.iterateConnectionPayloadFrom. PendingContent/LastClient/LastServer capture the
+// in-flight side-run state (the bytes accumulated for the current direction that haven't been dissected yet),
+// so a resume that lands mid side-run still produces the same Metadata a from-scratch walk would have.
+type ConnectionStreamCheckpoint struct {
+	ID                  RowID  `bson:"_id"`
+	ConnectionID        RowID  `bson:"connection_id"`
+	GlobalIndex         uint64 `bson:"global_index"`
+	ClientDocumentIndex int    `bson:"client_document_index"`
+	ClientBlocksIndex   int    `bson:"client_blocks_index"`
+	ClientIndex         uint64 `bson:"client_index"`
+	ServerDocumentIndex int    `bson:"server_document_index"`
+	ServerBlocksIndex   int    `bson:"server_blocks_index"`
+	ServerIndex         uint64 `bson:"server_index"`
+	PendingContent      []byte `bson:"pending_content"`
+	LastClient          bool   `bson:"last_client"`
+	LastServer          bool   `bson:"last_server"`
+}
+
+// connectionStreamCursor captures the merge-loop state that iterateConnectionPayloadFrom needs to resume
+// mid-stream. Its zero value is the starting state of a connection.
+type connectionStreamCursor struct {
+	clientDocumentIndex, clientBlocksIndex int
+	clientIndex                            uint64
+	serverDocumentIndex, serverBlocksIndex int
+	serverIndex                            uint64
+	globalIndex                            uint64
+	pendingContent                         []byte
+	lastClient, lastServer                 bool
+}
+
+func (cp ConnectionStreamCheckpoint) cursor() connectionStreamCursor {
+	return connectionStreamCursor{
+		clientDocumentIndex: cp.ClientDocumentIndex,
+		clientBlocksIndex:   cp.ClientBlocksIndex,
+		clientIndex:         cp.ClientIndex,
+		serverDocumentIndex: cp.ServerDocumentIndex,
+		serverBlocksIndex:   cp.ServerBlocksIndex,
+		serverIndex:         cp.ServerIndex,
+		globalIndex:         cp.GlobalIndex,
+		pendingContent:      cp.PendingContent,
+		lastClient:          cp.LastClient,
+		lastServer:          cp.LastServer,
+	}
+}
+
+// checkpointIndex is the in-process cache entry for a connection: its known checkpoints sorted by GlobalIndex.
+type checkpointIndex struct {
+	checkpoints []ConnectionStreamCheckpoint
+}
+
+// nearest returns the last checkpoint at or before globalIndex, if any.
+func (idx *checkpointIndex) nearest(globalIndex uint64) (ConnectionStreamCheckpoint, bool) {
+	i := sort.Search(len(idx.checkpoints), func(i int) bool {
+		return idx.checkpoints[i].GlobalIndex > globalIndex
+	})
+	if i == 0 {
+		return ConnectionStreamCheckpoint{}, false
+	}
+	return idx.checkpoints[i-1], true
+}
+
+// has reports whether a checkpoint already exists at exactly globalIndex, so persistCheckpoint can skip writing
+// a duplicate for a boundary that was already recorded by an earlier call.
+func (idx *checkpointIndex) has(globalIndex uint64) bool {
+	i := sort.Search(len(idx.checkpoints), func(i int) bool {
+		return idx.checkpoints[i].GlobalIndex >= globalIndex
+	})
+	return i < len(idx.checkpoints) && idx.checkpoints[i].GlobalIndex == globalIndex
+}
+
+const checkpointCacheCapacity = 256
+
+// checkpointCache is a small in-process LRU of per-connection checkpointIndex values, so a range request on a
+// connection that was recently served doesn't need a Mongo round trip to find its resume point.
+type checkpointCache struct {
+	mu    sync.Mutex
+	order []RowID
+	byKey map[RowID]*checkpointIndex
+}
+
+var globalCheckpointCache = &checkpointCache{byKey: make(map[RowID]*checkpointIndex)}
+
+func (c *checkpointCache) get(connectionID RowID) (*checkpointIndex, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	idx, ok := c.byKey[connectionID]
+	if ok {
+		for i, id := range c.order {
+			if id == connectionID {
+				c.order = append(append(c.order[:i], c.order[i+1:]...), connectionID)
+				break
+			}
+		}
+	}
+	return idx, ok
+}
+
+func (c *checkpointCache) put(connectionID RowID, idx *checkpointIndex) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exists := c.byKey[connectionID]; !exists {
+		if len(c.order) >= checkpointCacheCapacity {
+			delete(c.byKey, c.order[0])
+			c.order = c.order[1:]
+		}
+		c.order = append(c.order, connectionID)
+	}
+	c.byKey[connectionID] = idx
+}
+
+// invalidate drops a connection from the cache, used after a new checkpoint is persisted for it.
+func (c *checkpointCache) invalidate(connectionID RowID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.byKey, connectionID)
+}
+
+// loadCheckpointIndex returns the cached checkpointIndex for a connection, loading it from storage on a cache
+// miss.
+func (csc ConnectionStreamsController) loadCheckpointIndex(c context.Context, connectionID RowID) *checkpointIndex {
+	if idx, ok := globalCheckpointCache.get(connectionID); ok {
+		return idx
+	}
+
+	c, span := tracer.Start(c, "connection_streams.load_checkpoint_index",
+		trace.WithAttributes(attribute.String("connection_id", fmt.Sprintf("%v", connectionID))))
+	defer span.End()
+
+	var checkpoints []ConnectionStreamCheckpoint
+	if err := csc.storage.Find(ConnectionStreamCheckpoints).Filter(OrderedDocument{
+		{"connection_id", connectionID},
+	}).Sort(false, "global_index").Context(c).All(&checkpoints); err != nil {
+		recordSpanError(span, err)
+		log.WithError(err).WithField("connection_id", connectionID).Error("failed to load connection stream checkpoints")
+	}
+	span.SetAttributes(attribute.Int("checkpoints", len(checkpoints)))
+
+	idx := &checkpointIndex{checkpoints: checkpoints}
+	globalCheckpointCache.put(connectionID, idx)
+	return idx
+}
+
+// persistCheckpoint records a checkpoint so future range requests can resume from it, unless one already exists
+// at cur.globalIndex for this connection. Without that check, every plain GetConnectionPayload/
+// iterateConnectionPayload walk (the pre-existing, zero-cursor, heavily-used path) would insert a fresh
+// duplicate checkpoint at every document boundary on every call, since that path always starts from the zero
+// cursor and crosses the same boundaries again. It is otherwise best-effort: a failure is logged but never
+// interrupts the payload pipeline that is already serving the caller.
+func (csc ConnectionStreamsController) persistCheckpoint(c context.Context, connectionID RowID,
+	cur connectionStreamCursor) {
+	if csc.loadCheckpointIndex(c, connectionID).has(cur.globalIndex) {
+		return
+	}
+
+	checkpoint := ConnectionStreamCheckpoint{
+		ID:                  NewRowID(),
+		ConnectionID:        connectionID,
+		GlobalIndex:         cur.globalIndex,
+		ClientDocumentIndex: cur.clientDocumentIndex,
+		ClientBlocksIndex:   cur.clientBlocksIndex,
+		ClientIndex:         cur.clientIndex,
+		ServerDocumentIndex: cur.serverDocumentIndex,
+		ServerBlocksIndex:   cur.serverBlocksIndex,
+		ServerIndex:         cur.serverIndex,
+		PendingContent:      append([]byte(nil), cur.pendingContent...),
+		LastClient:          cur.lastClient,
+		LastServer:          cur.lastServer,
+	}
+	if err := csc.storage.Insert(ConnectionStreamCheckpoints).Context(c).One(checkpoint); err != nil {
+		log.WithError(err).WithField("connection_id", connectionID).Error("failed to persist a connection stream checkpoint")
+		return
+	}
+	globalCheckpointCache.invalidate(connectionID)
+}
+
+// MigrateConnectionStreamIntervals back-fills ConnectionStreamCheckpoints for connections that were recorded
+// before this index existed, by replaying each connection's merge loop once from the start. It is meant to be
+// run once as a migration; connections touched after it runs keep their index up to date incrementally via
+// persistCheckpoint.
+func (csc ConnectionStreamsController) MigrateConnectionStreamIntervals(c context.Context) error {
+	var connectionIDs []RowID
+	if err := csc.storage.Find(ConnectionStreams).Context(c).Distinct("connection_id", &connectionIDs); err != nil {
+		return err
+	}
+
+	for _, connectionID := range connectionIDs {
+		idx := csc.loadCheckpointIndex(c, connectionID)
+		if len(idx.checkpoints) > 0 {
+			continue // already indexed, either by a previous migration run or by live traffic
+		}
+
+		csc.iterateConnectionPayload(c, connectionID, QueryFormat{Limit: ^uint64(0)}, func(*Payload) bool {
+			return true
+		})
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import "testing"
+
+func TestCheckpointIndexNearest(t *testing.T) {
+	idx := &checkpointIndex{checkpoints: []ConnectionStreamCheckpoint{
+		{GlobalIndex: 100},
+		{GlobalIndex: 250},
+		{GlobalIndex: 400},
+	}}
+
+	tests := []struct {
+		name        string
+		globalIndex uint64
+		wantFound   bool
+		wantIndex   uint64
+	}{
+		{"before the first checkpoint", 50, false, 0},
+		{"exactly on a checkpoint", 250, true, 250},
+		{"mid-burst, between two checkpoints, resolves to the earlier one", 300, true, 250},
+		{"exactly on the first checkpoint", 100, true, 100},
+		{"past the last checkpoint", 1000, true, 400},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, found := idx.nearest(tt.globalIndex)
+			if found != tt.wantFound {
+				t.Fatalf("nearest(%d) found = %v, want %v", tt.globalIndex, found, tt.wantFound)
+			}
+			if found && got.GlobalIndex != tt.wantIndex {
+				t.Errorf("nearest(%d).GlobalIndex = %d, want %d", tt.globalIndex, got.GlobalIndex, tt.wantIndex)
+			}
+		})
+	}
+}
+
+// TestCheckpointIndexHas exercises the lookup persistCheckpoint relies on to avoid writing a duplicate
+// checkpoint for a boundary it has already recorded.
+func TestCheckpointIndexHas(t *testing.T) {
+	idx := &checkpointIndex{checkpoints: []ConnectionStreamCheckpoint{
+		{GlobalIndex: 100},
+		{GlobalIndex: 250},
+	}}
+
+	for _, tt := range []struct {
+		globalIndex uint64
+		want        bool
+	}{
+		{100, true},
+		{250, true},
+		{150, false},
+		{0, false},
+		{300, false},
+	} {
+		if got := idx.has(tt.globalIndex); got != tt.want {
+			t.Errorf("has(%d) = %v, want %v", tt.globalIndex, got, tt.want)
+		}
+	}
+}
+
+func TestCheckpointIndexNearestEmpty(t *testing.T) {
+	idx := &checkpointIndex{}
+	if _, found := idx.nearest(0); found {
+		t.Error("nearest on an empty index should never report a match")
+	}
+	if idx.has(0) {
+		t.Error("has on an empty index should never report a match")
+	}
+}
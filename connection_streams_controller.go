@@ -3,8 +3,15 @@ package main
 import (
 	"bytes"
 	"context"
-	"github.com/eciavatta/caronte/parsers"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"time"
 )
 
@@ -27,14 +34,14 @@ type ConnectionStream struct {
 type PatternSlice [2]uint64
 
 type Payload struct {
-	FromClient             bool             `json:"from_client"`
-	Content                string           `json:"content"`
-	Metadata               parsers.Metadata `json:"metadata"`
-	IsMetadataContinuation bool             `json:"is_metadata_continuation"`
-	Index                  int              `json:"index"`
-	Timestamp              time.Time        `json:"timestamp"`
-	IsRetransmitted        bool             `json:"is_retransmitted"`
-	RegexMatches           []RegexSlice     `json:"regex_matches"`
+	FromClient             bool               `json:"from_client"`
+	Content                string             `json:"content"`
+	Metadata               *DissectedMetadata `json:"metadata"`
+	IsMetadataContinuation bool               `json:"is_metadata_continuation"`
+	Index                  int                `json:"index"`
+	Timestamp              time.Time          `json:"timestamp"`
+	IsRetransmitted        bool               `json:"is_retransmitted"`
+	RegexMatches           []RegexSlice       `json:"regex_matches"`
 }
 
 type RegexSlice struct {
@@ -43,9 +50,10 @@ type RegexSlice struct {
 }
 
 type QueryFormat struct {
-	Format string `form:"format"`
-	Skip   uint64 `form:"skip"`
-	Limit  uint64 `form:"limit"`
+	Format    string `form:"format"`
+	Skip      uint64 `form:"skip"`
+	Limit     uint64 `form:"limit"`
+	Dissector string `form:"dissector"`
 }
 
 type ConnectionStreamsController struct {
@@ -61,14 +69,163 @@ func NewConnectionStreamsController(storage Storage) ConnectionStreamsController
 func (csc ConnectionStreamsController) GetConnectionPayload(c context.Context, connectionID RowID,
 	format QueryFormat) []*Payload {
 	payloads := make([]*Payload, 0, InitialPayloadsSize)
-	var clientIndex, serverIndex, globalIndex uint64
+	csc.iterateConnectionPayload(c, connectionID, format, func(payload *Payload) bool {
+		payloads = append(payloads, payload)
+		return true
+	})
+	return payloads
+}
+
+// StreamConnectionPayload pushes the payloads of a connection to the client as they are decoded, instead of
+// materializing the whole slice in memory first. It negotiates the transport based on the request: a
+// "Connection: Upgrade" header upgrades to a WebSocket, otherwise the response is sent as Server-Sent Events.
+// There is no way to request a WebSocket other than that header - gorilla/websocket's Upgrade validates it
+// unconditionally, so a query-parameter fallback couldn't actually complete the handshake on its own. format.Skip
+// is used as the resume cursor: a client that was pushed payloads up
+// to a given globalIndex can reconnect with format.Skip set to that globalIndex to resume mid-stream. Like
+// GetConnectionPayloadRange, the resume is served from the closest checkpoint known for the connection instead
+// of always replaying the merge loop from document 0 on both sides; because that checkpoint also carries the
+// in-flight side-run bytes (see connectionStreamCursor.pendingContent), a reconnect mid-burst resumes dissection
+// from the same pending bytes a from-scratch walk would have. Each payload is written as soon as it is decoded,
+// before the rest of its side-run has been read and dissected, so streamed payloads are sent with a null
+// Metadata; only the last payload of the connection is sent with its Metadata filled in.
+func (csc ConnectionStreamsController) StreamConnectionPayload(ginContext *gin.Context, connectionID RowID,
+	format QueryFormat) {
+	if websocket.IsWebSocketUpgrade(ginContext.Request) {
+		csc.streamConnectionPayloadWS(ginContext, connectionID, format)
+	} else {
+		csc.streamConnectionPayloadSSE(ginContext, connectionID, format)
+	}
+}
+
+func (csc ConnectionStreamsController) streamConnectionPayloadSSE(ginContext *gin.Context, connectionID RowID,
+	format QueryFormat) {
+	c := ginContext.Request.Context()
+	w := ginContext.Writer
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	cur := csc.resumeCursor(c, connectionID, format.Skip)
+	format.Skip -= cur.globalIndex
+
+	flusher, canFlush := w.(http.Flusher)
+	csc.iterateConnectionPayloadFrom(c, connectionID, format, cur, func(payload *Payload) bool {
+		if c.Err() != nil {
+			return false
+		}
+		encoded, err := json.Marshal(payload)
+		if err != nil {
+			log.WithError(err).Error("failed to marshal a Payload for streaming")
+			return true
+		}
+		if _, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", payload.Index, encoded); err != nil {
+			return false
+		}
+		if canFlush {
+			flusher.Flush()
+		}
+		return true
+	})
+}
+
+func (csc ConnectionStreamsController) streamConnectionPayloadWS(ginContext *gin.Context, connectionID RowID,
+	format QueryFormat) {
+	upgrader := websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
+	conn, err := upgrader.Upgrade(ginContext.Writer, ginContext.Request, nil)
+	if err != nil {
+		log.WithError(err).Error("failed to upgrade connection to websocket")
+		return
+	}
+	defer conn.Close()
+
+	c := ginContext.Request.Context()
+	cur := csc.resumeCursor(c, connectionID, format.Skip)
+	format.Skip -= cur.globalIndex
+
+	csc.iterateConnectionPayloadFrom(c, connectionID, format, cur, func(payload *Payload) bool {
+		if c.Err() != nil {
+			return false
+		}
+		if err := conn.WriteJSON(payload); err != nil {
+			return false
+		}
+		return true
+	})
+}
+
+// iterateConnectionPayload walks a connection's payloads from the start, invoking emit for each one as soon as
+// it is decoded rather than accumulating them. emit returns false to stop the iteration early (e.g. the client
+// disconnected or the limit was reached).
+func (csc ConnectionStreamsController) iterateConnectionPayload(c context.Context, connectionID RowID,
+	format QueryFormat, emit func(payload *Payload) bool) {
+	csc.iterateConnectionPayloadFrom(c, connectionID, format, connectionStreamCursor{}, emit)
+}
+
+// GetConnectionPayloadRange returns the payloads that cover the bytes from fromGlobalIndex through toGlobalIndex:
+// the first one returned can start before fromGlobalIndex, and the last one is the payload holding byte
+// toGlobalIndex, so it can extend past it. It resumes the merge loop from the closest known checkpoint instead of always replaying it from document 0 on
+// both sides. On a connection with no checkpoint yet (never served, or older than this index), it falls back to
+// iterating from the start, which also leaves fresh checkpoints behind for the next call. Returns no payloads,
+// rather than the whole rest of the connection, when toGlobalIndex <= fromGlobalIndex.
+func (csc ConnectionStreamsController) GetConnectionPayloadRange(c context.Context, connectionID RowID,
+	fromGlobalIndex, toGlobalIndex uint64, format QueryFormat) []*Payload {
+	payloads := make([]*Payload, 0, InitialPayloadsSize)
+	if toGlobalIndex <= fromGlobalIndex {
+		// toGlobalIndex - fromGlobalIndex below would otherwise wrap around as an unsigned subtraction and be
+		// interpreted as a huge format.Limit, returning far more payloads than the (empty) requested range.
+		return payloads
+	}
+
+	cur := csc.resumeCursor(c, connectionID, fromGlobalIndex)
+	format.Skip = fromGlobalIndex - cur.globalIndex
+	format.Limit = toGlobalIndex - fromGlobalIndex
+
+	csc.iterateConnectionPayloadFrom(c, connectionID, format, cur, func(payload *Payload) bool {
+		payloads = append(payloads, payload)
+		return true
+	})
+	return payloads
+}
+
+// resumeCursor returns the closest known checkpoint at or before fromGlobalIndex, or the zero cursor (start of
+// the connection) if none has been recorded yet. Shared by GetConnectionPayloadRange and the SSE/WS streaming
+// endpoint so a client resuming from a globalIndex never pays the full replay-from-document-0 cost that the
+// checkpoint index exists to avoid, and so a reconnect that lands mid side-run still resumes dissection from the
+// same pending bytes a full replay would have accumulated.
+func (csc ConnectionStreamsController) resumeCursor(c context.Context, connectionID RowID,
+	fromGlobalIndex uint64) connectionStreamCursor {
+	if checkpoint, ok := csc.loadCheckpointIndex(c, connectionID).nearest(fromGlobalIndex); ok {
+		return checkpoint.cursor()
+	}
+	return connectionStreamCursor{}
+}
+
+// iterateConnectionPayloadFrom is the merge loop shared by iterateConnectionPayload and
+// GetConnectionPayloadRange: it walks the client/server ConnectionStreams starting at cur, treating
+// format.Skip/format.Limit as relative to cur.globalIndex, and persists a checkpoint every time it crosses a
+// document boundary so a later range request can resume from there. The checkpoint carries the not-yet-dissected
+// bytes of the in-flight side-run (cur.pendingContent/lastClient/lastServer), so a resume that lands mid side-run
+// still produces the same Metadata a from-scratch walk would have. Each call is its own walkID (see dissectKey),
+// so a dissector with cross-call state (HTTP/2's HPACK decoder) never shares it with another concurrent or
+// subsequent call over the same connection/direction.
+func (csc ConnectionStreamsController) iterateConnectionPayloadFrom(c context.Context, connectionID RowID,
+	format QueryFormat, cur connectionStreamCursor, emit func(payload *Payload) bool) {
+	c, span := tracer.Start(c, "connection_streams.iterate_connection_payload",
+		trace.WithAttributes(attribute.String("connection_id", fmt.Sprintf("%v", connectionID))))
+	defer span.End()
+
+	walkID := newWalkID()
+	clientIndex, serverIndex, globalIndex := cur.clientIndex, cur.serverIndex, cur.globalIndex
+	skip, limit := cur.globalIndex+format.Skip, format.Limit
 
 	if format.Limit <= 0 {
-		format.Limit = DefaultQueryFormatLimit
+		limit = DefaultQueryFormatLimit
 	}
 
-	var clientBlocksIndex, serverBlocksIndex int
-	var clientDocumentIndex, serverDocumentIndex int
+	clientBlocksIndex, serverBlocksIndex := cur.clientBlocksIndex, cur.serverBlocksIndex
+	clientDocumentIndex, serverDocumentIndex := cur.clientDocumentIndex, cur.serverDocumentIndex
 	clientStream := csc.getConnectionStream(c, connectionID, true, clientDocumentIndex)
 	serverStream := csc.getConnectionStream(c, connectionID, false, serverDocumentIndex)
 
@@ -81,9 +238,10 @@ func (csc ConnectionStreamsController) GetConnectionPayload(c context.Context, c
 
 	var payload *Payload
 	payloadsBuffer := make([]*Payload, 0, 16)
-	contentChunkBuffer := new(bytes.Buffer)
+	contentChunkBuffer := bytes.NewBuffer(append([]byte(nil), cur.pendingContent...))
 	var lastContentSlice []byte
-	var sideChanged, lastClient, lastServer bool
+	var sideChanged bool
+	lastClient, lastServer := cur.lastClient, cur.lastServer
 	for !clientStream.ID.IsZero() || !serverStream.ID.IsZero() {
 		if hasClientBlocks() && (!hasServerBlocks() || // next payload is from client
 			clientStream.BlocksTimestamps[clientBlocksIndex].UnixNano() <=
@@ -103,14 +261,14 @@ func (csc ConnectionStreamsController) GetConnectionPayload(c context.Context, c
 				Index:           start,
 				Timestamp:       clientStream.BlocksTimestamps[clientBlocksIndex],
 				IsRetransmitted: clientStream.BlocksLoss[clientBlocksIndex],
-				RegexMatches:    findMatchesBetween(clientStream.PatternMatches, clientIndex, clientIndex+size),
+				RegexMatches:    findMatchesBetween(c, clientStream, clientIndex, clientIndex+size),
 			}
 			clientIndex += size
 			globalIndex += size
 			clientBlocksIndex++
 
 			lastContentSlice = clientStream.Payload[start:end]
-			sideChanged, lastClient, lastServer = lastServer, true, false
+			sideChanged = lastServer
 		} else { // next payload is from server
 			start := serverStream.BlocksIndexes[serverBlocksIndex]
 			end := 0
@@ -127,16 +285,18 @@ func (csc ConnectionStreamsController) GetConnectionPayload(c context.Context, c
 				Index:           start,
 				Timestamp:       serverStream.BlocksTimestamps[serverBlocksIndex],
 				IsRetransmitted: serverStream.BlocksLoss[serverBlocksIndex],
-				RegexMatches:    findMatchesBetween(serverStream.PatternMatches, serverIndex, serverIndex+size),
+				RegexMatches:    findMatchesBetween(c, serverStream, serverIndex, serverIndex+size),
 			}
 			serverIndex += size
 			globalIndex += size
 			serverBlocksIndex++
 
 			lastContentSlice = serverStream.Payload[start:end]
-			sideChanged, lastClient, lastServer = lastClient, false, true
+			sideChanged = lastClient
 		}
 
+		crossedBoundary := (!hasClientBlocks() && !clientStream.ID.IsZero()) ||
+			(!hasServerBlocks() && !serverStream.ID.IsZero())
 		if !hasClientBlocks() {
 			clientDocumentIndex++
 			clientBlocksIndex = 0
@@ -149,7 +309,8 @@ func (csc ConnectionStreamsController) GetConnectionPayload(c context.Context, c
 		}
 
 		updateMetadata := func() {
-			metadata := parsers.Parse(contentChunkBuffer.Bytes())
+			key := dissectKey{connectionID: connectionID, fromClient: lastClient, walkID: walkID}
+			metadata := DissectContentChunk(c, key, contentChunkBuffer.Bytes(), format.Dissector)
 			var isMetadataContinuation bool
 			for _, elem := range payloadsBuffer {
 				elem.Metadata = metadata
@@ -161,67 +322,97 @@ func (csc ConnectionStreamsController) GetConnectionPayload(c context.Context, c
 			contentChunkBuffer.Reset()
 		}
 
+		// updateMetadata (when sideChanged) must run, and lastClient/lastServer must still describe the
+		// side the *buffered* content belongs to, before they are advanced to the current payload below -
+		// otherwise the dissector would be keyed on the wrong direction.
 		if sideChanged {
 			updateMetadata()
 		}
 		payloadsBuffer = append(payloadsBuffer, payload)
 		contentChunkBuffer.Write(lastContentSlice)
+		lastClient, lastServer = payload.FromClient, !payload.FromClient
 
 		if clientStream.ID.IsZero() && serverStream.ID.IsZero() {
 			updateMetadata()
 		}
 
-		if globalIndex > format.Skip {
-			// problem: waste of time if the payload is discarded
-			payloads = append(payloads, payload)
+		if crossedBoundary {
+			// Captured after the buffer/metadata bookkeeping above so pendingContent reflects exactly the
+			// bytes of the current side-run that haven't been dissected yet, whatever document boundary they
+			// happen to span.
+			csc.persistCheckpoint(c, connectionID, connectionStreamCursor{
+				clientDocumentIndex: clientDocumentIndex,
+				clientBlocksIndex:   clientBlocksIndex,
+				clientIndex:         clientIndex,
+				serverDocumentIndex: serverDocumentIndex,
+				serverBlocksIndex:   serverBlocksIndex,
+				serverIndex:         serverIndex,
+				globalIndex:         globalIndex,
+				pendingContent:      contentChunkBuffer.Bytes(),
+				lastClient:          lastClient,
+				lastServer:          lastServer,
+			})
+		}
+
+		if globalIndex > skip {
+			if !emit(payload) {
+				return
+			}
 		}
-		if globalIndex > format.Skip+format.Limit {
+		if globalIndex > skip+limit {
 			// problem: the last chunk is not parsed, but can be ok because it is not finished
 			updateMetadata()
-			return payloads
+			return
 		}
 	}
-
-	return payloads
 }
 
 func (csc ConnectionStreamsController) getConnectionStream(c context.Context, connectionID RowID, fromClient bool,
 	documentIndex int) ConnectionStream {
+	c, span := tracer.Start(c, "connection_streams.get_connection_stream", trace.WithAttributes(
+		attribute.String("connection_id", fmt.Sprintf("%v", connectionID)),
+		attribute.Bool("from_client", fromClient),
+		attribute.Int("document_index", documentIndex),
+	))
+	defer span.End()
+
 	var result ConnectionStream
 	if err := csc.storage.Find(ConnectionStreams).Filter(OrderedDocument{
 		{"connection_id", connectionID},
 		{"from_client", fromClient},
 		{"document_index", documentIndex},
 	}).Context(c).First(&result); err != nil {
+		recordSpanError(span, err)
 		log.WithError(err).WithField("connection_id", connectionID).Panic("failed to get a ConnectionStream")
 	}
 	return result
 }
 
-func findMatchesBetween(patternMatches map[uint][]PatternSlice, from, to uint64) []RegexSlice {
-	regexSlices := make([]RegexSlice, 0, InitialRegexSlicesCount)
-	for _, slices := range patternMatches {
-		for _, slice := range slices {
-			if from > slice[1] || to <= slice[0] {
-				continue
-			}
+func findMatchesBetween(c context.Context, stream ConnectionStream, from, to uint64) []RegexSlice {
+	_, span := tracer.Start(c, "connection_streams.find_matches_between",
+		trace.WithAttributes(attribute.Int64("from", int64(from)), attribute.Int64("to", int64(to))))
+	defer span.End()
 
-			log.Info(slice[0], slice[1], from, to)
-			var start, end uint64
-			if from > slice[0] {
-				start = 0
-			} else {
-				start = slice[0] - from
-			}
+	tree := globalPatternMatchTreeCache.get(stream.ID, stream.PatternMatches)
+	overlaps := tree.query(from, to)
 
-			if to <= slice[1] {
-				end = to - from
-			} else {
-				end = slice[1] - from
-			}
+	regexSlices := make([]RegexSlice, 0, len(overlaps))
+	for _, slice := range overlaps {
+		var start, end uint64
+		if from > slice.from {
+			start = 0
+		} else {
+			start = slice.from - from
+		}
 
-			regexSlices = append(regexSlices, RegexSlice{From: start, To: end})
+		if to <= slice.to {
+			end = to - from
+		} else {
+			end = slice.to - from
 		}
+
+		regexSlices = append(regexSlices, RegexSlice{From: start, To: end})
 	}
+	span.SetAttributes(attribute.Int("matches", len(regexSlices)))
 	return regexSlices
 }
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+// TestGetConnectionPayloadRangeEmptyRange guards against toGlobalIndex-fromGlobalIndex wrapping around as an
+// unsigned subtraction when toGlobalIndex <= fromGlobalIndex: that used to turn an empty requested range into a
+// huge format.Limit instead of the empty result the caller asked for. A zero-value ConnectionStreamsController
+// is enough here since the empty-range check must return before any storage access happens.
+func TestGetConnectionPayloadRangeEmptyRange(t *testing.T) {
+	csc := ConnectionStreamsController{}
+	var connectionID RowID
+
+	for _, tt := range []struct {
+		name                           string
+		fromGlobalIndex, toGlobalIndex uint64
+	}{
+		{"equal bounds", 100, 100},
+		{"inverted bounds", 100, 50},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := csc.GetConnectionPayloadRange(context.Background(), connectionID, tt.fromGlobalIndex,
+				tt.toGlobalIndex, QueryFormat{})
+			if len(got) != 0 {
+				t.Errorf("GetConnectionPayloadRange(%d, %d) = %d payloads, want 0",
+					tt.fromGlobalIndex, tt.toGlobalIndex, len(got))
+			}
+		})
+	}
+}
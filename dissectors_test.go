@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestRedisDissector(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		matches  bool
+		wantType string
+		wantArgs []string
+	}{
+		{"array", []byte("*2\r\n$3\r\nfoo\r\n$3\r\nbar\r\n"), true, "array", []string{"foo", "bar"}},
+		{"simple string", []byte("+OK\r\n"), true, "simple_string", nil},
+		{"error", []byte("-ERR unknown command\r\n"), true, "error", nil},
+		{"integer", []byte(":1000\r\n"), true, "integer", nil},
+		{"bulk string", []byte("$3\r\nfoo\r\n"), true, "bulk_string", nil},
+		{"not RESP", []byte("hello"), false, "", nil},
+		{"empty", []byte{}, false, "", nil},
+	}
+
+	d := redisDissector{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := d.Matches(tt.data); got != tt.matches {
+				t.Fatalf("Matches() = %v, want %v", got, tt.matches)
+			}
+			if !tt.matches {
+				return
+			}
+			meta := d.Dissect(dissectKey{}, tt.data).Redis
+			if meta.Type != tt.wantType {
+				t.Errorf("Type = %q, want %q", meta.Type, tt.wantType)
+			}
+			if !equalStrings(meta.Args, tt.wantArgs) {
+				t.Errorf("Args = %v, want %v", meta.Args, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func buildMySQLHandshake(serverVersion string, connectionID uint32) []byte {
+	data := []byte{0, 0, 0, 0} // 3-byte packet length + 1-byte sequence number, unused by the dissector
+	data = append(data, 0x0a)  // protocol version
+	data = append(data, []byte(serverVersion)...)
+	data = append(data, 0) // NUL terminator
+	connIDBytes := make([]byte, 4)
+	binary.LittleEndian.PutUint32(connIDBytes, connectionID)
+	return append(data, connIDBytes...)
+}
+
+func TestMySQLDissector(t *testing.T) {
+	data := buildMySQLHandshake("5.7.26", 12345)
+	d := mySQLDissector{}
+
+	if !d.Matches(data) {
+		t.Fatal("Matches() = false, want true for a v10 handshake packet")
+	}
+	meta := d.Dissect(dissectKey{}, data).MySQL
+	if meta.ProtocolVersion != 0x0a {
+		t.Errorf("ProtocolVersion = %#x, want 0x0a", meta.ProtocolVersion)
+	}
+	if meta.ServerVersion != "5.7.26" {
+		t.Errorf("ServerVersion = %q, want %q", meta.ServerVersion, "5.7.26")
+	}
+	if meta.ConnectionID != 12345 {
+		t.Errorf("ConnectionID = %d, want %d", meta.ConnectionID, 12345)
+	}
+
+	if d.Matches([]byte{0, 0, 0, 0, 0x0b, 0}) {
+		t.Error("Matches() = true for a non-0x0a protocol version, want false")
+	}
+}
+
+// buildClientHello assembles a minimal TLS 1.2 ClientHello record, optionally carrying the server_name (SNI) and
+// application_layer_protocol_negotiation (ALPN) extensions, to exercise parseClientHelloExtensions without a
+// real TLS stack.
+func buildClientHello(t *testing.T, sni string, alpn []string) []byte {
+	t.Helper()
+
+	var body bytes.Buffer
+	body.WriteByte(0x01)           // handshake type: ClientHello
+	body.Write([]byte{0, 0, 0})    // handshake length, unused by the parser
+	body.Write([]byte{0x03, 0x03}) // client version: TLS 1.2
+	body.Write(make([]byte, 32))   // random
+	body.WriteByte(0)              // session ID length: 0
+
+	cipherSuites := []byte{0x00, 0x2f}
+	mustWrite(t, &body, uint16(len(cipherSuites)))
+	body.Write(cipherSuites)
+
+	body.WriteByte(1) // compression methods length
+	body.WriteByte(0) // null compression
+
+	var extensions bytes.Buffer
+	if sni != "" {
+		var list bytes.Buffer
+		list.WriteByte(0) // host_name
+		mustWrite(t, &list, uint16(len(sni)))
+		list.WriteString(sni)
+		var ext bytes.Buffer
+		mustWrite(t, &ext, uint16(list.Len())) // server_name_list length
+		ext.Write(list.Bytes())
+
+		mustWrite(t, &extensions, uint16(0x0000)) // server_name
+		mustWrite(t, &extensions, uint16(ext.Len()))
+		extensions.Write(ext.Bytes())
+	}
+	if len(alpn) > 0 {
+		var list bytes.Buffer
+		for _, proto := range alpn {
+			list.WriteByte(byte(len(proto)))
+			list.WriteString(proto)
+		}
+		var ext bytes.Buffer
+		mustWrite(t, &ext, uint16(list.Len()))
+		ext.Write(list.Bytes())
+
+		mustWrite(t, &extensions, uint16(0x0010)) // ALPN
+		mustWrite(t, &extensions, uint16(ext.Len()))
+		extensions.Write(ext.Bytes())
+	}
+
+	mustWrite(t, &body, uint16(extensions.Len()))
+	body.Write(extensions.Bytes())
+
+	record := []byte{0x16, 0x03, 0x03, 0, 0} // content type, version, length (unused by the dissector)
+	return append(record, body.Bytes()...)
+}
+
+func mustWrite(t *testing.T, buf *bytes.Buffer, v uint16) {
+	t.Helper()
+	if err := binary.Write(buf, binary.BigEndian, v); err != nil {
+		t.Fatalf("binary.Write: %v", err)
+	}
+}
+
+func TestTLSDissectorClientHelloExtensions(t *testing.T) {
+	tests := []struct {
+		name     string
+		sni      string
+		alpn     []string
+		wantSNI  string
+		wantALPN []string
+	}{
+		{"SNI only", "example.com", nil, "example.com", nil},
+		{"ALPN only", "", []string{"h2", "http/1.1"}, "", []string{"h2", "http/1.1"}},
+		{"SNI and ALPN", "example.com", []string{"h2"}, "example.com", []string{"h2"}},
+		{"neither extension", "", nil, "", nil},
+	}
+
+	d := tlsDissector{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := buildClientHello(t, tt.sni, tt.alpn)
+			if !d.Matches(data) {
+				t.Fatal("Matches() = false, want true for a TLS record header")
+			}
+			meta := d.Dissect(dissectKey{}, data).TLS
+			if meta.ServerName != tt.wantSNI {
+				t.Errorf("ServerName = %q, want %q", meta.ServerName, tt.wantSNI)
+			}
+			if !equalStrings(meta.ALPNProtocols, tt.wantALPN) {
+				t.Errorf("ALPNProtocols = %v, want %v", meta.ALPNProtocols, tt.wantALPN)
+			}
+		})
+	}
+}
+
+func TestTLSDissectorMatches(t *testing.T) {
+	d := tlsDissector{}
+	if d.Matches([]byte("not tls")) {
+		t.Error("Matches() = true for non-TLS data, want false")
+	}
+	if d.Matches([]byte{0x16, 0x03}) {
+		t.Error("Matches() = true for a truncated record, want false")
+	}
+}
+
+// -- HTTP/2 HPACK dynamic table reuse across Dissect calls -----------------------------------------------------
+
+// hpackString encodes s as an HPACK "string literal" without Huffman coding: a one-byte length (top bit clear)
+// followed by the raw bytes. Good enough for the short ASCII header names/values these tests need.
+func hpackString(s string) []byte {
+	return append([]byte{byte(len(s))}, []byte(s)...)
+}
+
+// hpackLiteralNewName builds a "Literal Header Field with Incremental Indexing - New Name" representation
+// (RFC 7541 6.2.1): it both yields (name, value) to the caller and inserts them into the decoder's dynamic
+// table, which is exactly the instruction this test needs to populate the table it later indexes back into.
+func hpackLiteralNewName(name, value string) []byte {
+	b := []byte{0x40}
+	b = append(b, hpackString(name)...)
+	b = append(b, hpackString(value)...)
+	return b
+}
+
+// buildHTTP2HeadersFrame wraps an already hpack-encoded header block in a HEADERS frame header (9-byte frame
+// header + payload), matching the layout http2Dissector.Dissect parses.
+func buildHTTP2HeadersFrame(streamID uint32, headerBlock []byte) []byte {
+	length := len(headerBlock)
+	frame := []byte{
+		byte(length >> 16), byte(length >> 8), byte(length), // 24-bit length
+		0x1, // type: HEADERS
+		0x0, // flags
+	}
+	frame = append(frame, byte(streamID>>24), byte(streamID>>16), byte(streamID>>8), byte(streamID))
+	return append(frame, headerBlock...)
+}
+
+// TestHTTP2DissectorDynamicTableReuseAcrossCalls pins the behavior the http2DecoderCache/dissectKey.walkID
+// scoping exists for: two Dissect calls carrying the same dissectKey (the same logical walk) must share one
+// hpack.Decoder, so a header added to the dynamic table by an earlier HEADERS block can be referenced by index
+// from a later one - exactly how a real HTTP/2 connection spans many frames against one dynamic table.
+func TestHTTP2DissectorDynamicTableReuseAcrossCalls(t *testing.T) {
+	d := http2Dissector{}
+	key := dissectKey{fromClient: true, walkID: 1}
+
+	// First call inserts "custom-header: custom-value" into the dynamic table; newly inserted entries land at
+	// index 62 (RFC 7541's static table occupies indices 1-61).
+	first := buildHTTP2HeadersFrame(1, hpackLiteralNewName("custom-header", "custom-value"))
+	firstMeta := d.Dissect(key, first).HTTP2
+	if got := firstMeta.Frames[0].Headers["custom-header"]; got != "custom-value" {
+		t.Fatalf("first call Headers[custom-header] = %q, want %q", got, "custom-value")
+	}
+
+	// Second call, same key: an Indexed Header Field referencing index 62 should resolve to the entry the first
+	// call added, proving the decoder (and its dynamic table) persisted across the two calls.
+	second := buildHTTP2HeadersFrame(1, []byte{0x80 | 62})
+	secondMeta := d.Dissect(key, second).HTTP2
+	if got := secondMeta.Frames[0].Headers["custom-header"]; got != "custom-value" {
+		t.Fatalf("second call (same key) Headers[custom-header] = %q, want %q (dynamic table was not reused)",
+			got, "custom-value")
+	}
+}
+
+// TestHTTP2DissectorDynamicTableNotSharedAcrossWalks is the flip side: a different dissectKey (a different
+// walkID, i.e. a separate logical walk of the same connection/direction) must get its own decoder with an empty
+// dynamic table, so indexing into an entry only a different walk ever inserted fails to decode instead of
+// silently returning that other walk's data.
+func TestHTTP2DissectorDynamicTableNotSharedAcrossWalks(t *testing.T) {
+	d := http2Dissector{}
+
+	seeded := dissectKey{fromClient: true, walkID: 10}
+	d.Dissect(seeded, buildHTTP2HeadersFrame(1, hpackLiteralNewName("custom-header", "custom-value")))
+
+	other := dissectKey{fromClient: true, walkID: 11}
+	meta := d.Dissect(other, buildHTTP2HeadersFrame(1, []byte{0x80 | 62})).HTTP2
+	if _, ok := meta.Frames[0].Headers["custom-header"]; ok {
+		t.Error("a fresh walkID resolved an index into another walk's dynamic table, want an undecoded frame")
+	}
+}
+
+// -- gRPC length-prefixed framing -------------------------------------------------------------------------------
+
+func buildGRPCMessage(compressed bool, payload []byte) []byte {
+	msg := []byte{0}
+	if compressed {
+		msg[0] = 1
+	}
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(payload)))
+	msg = append(msg, length...)
+	return append(msg, payload...)
+}
+
+func TestGRPCDissector(t *testing.T) {
+	d := grpcDissector{}
+	data := append(buildGRPCMessage(false, []byte("hello")), buildGRPCMessage(true, []byte("worldly"))...)
+
+	if !d.Matches(data) {
+		t.Fatal("Matches() = false, want true for a length-prefixed gRPC message stream")
+	}
+	meta := d.Dissect(dissectKey{}, data).GRPC
+	if len(meta.Messages) != 2 {
+		t.Fatalf("len(Messages) = %d, want 2", len(meta.Messages))
+	}
+	if meta.Messages[0].Compressed || meta.Messages[0].Length != 5 {
+		t.Errorf("Messages[0] = %+v, want {Compressed:false Length:5}", meta.Messages[0])
+	}
+	if !meta.Messages[1].Compressed || meta.Messages[1].Length != 7 {
+		t.Errorf("Messages[1] = %+v, want {Compressed:true Length:7}", meta.Messages[1])
+	}
+
+	if d.Matches([]byte{0, 0}) {
+		t.Error("Matches() = true for a truncated length prefix, want false")
+	}
+}
+
+// -- AMQP -----------------------------------------------------------------------------------------------------
+
+func TestAMQPDissector(t *testing.T) {
+	d := amqpDissector{}
+
+	protocolHeader := []byte("AMQP\x00\x00\x09\x01")
+	if !d.Matches(protocolHeader) {
+		t.Fatal("Matches() = false, want true for the AMQP protocol header")
+	}
+	if meta := d.Dissect(dissectKey{}, protocolHeader).AMQP; !meta.IsProtocolHeader {
+		t.Error("IsProtocolHeader = false, want true for the AMQP protocol header")
+	}
+
+	frame := []byte{1, 0, 7, 0, 0, 0, 0, 0xce} // type 1 (method), channel 7, zero-length payload, end marker
+	if !d.Matches(frame) {
+		t.Fatal("Matches() = false, want true for a well-formed AMQP frame")
+	}
+	meta := d.Dissect(dissectKey{}, frame).AMQP
+	if meta.FrameType != 1 || meta.Channel != 7 || meta.PayloadSize != 0 {
+		t.Errorf("meta = %+v, want {FrameType:1 Channel:7 PayloadSize:0}", meta)
+	}
+
+	if d.Matches([]byte{1, 0, 7, 0, 0, 0, 0, 0x00}) {
+		t.Error("Matches() = true for a frame missing the 0xce end marker, want false")
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import "sync"
+
+// patternInterval is a single PatternSlice flattened out of ConnectionStream.PatternMatches, so it can be stored
+// as one leaf of a patternMatchTree. The pattern ID the slice was recorded under is not kept.
+type patternInterval struct {
+	from, to uint64
+}
+
+// patternMatchTree is a static, augmented interval tree (a balanced BST keyed on interval start, each node
+// storing the max end among its subtree) built once from a ConnectionStream's PatternMatches. It answers
+// "which intervals overlap [from, to)" queries in O(log N + K) instead of the O(N) linear scan it replaces.
+type patternMatchTree struct {
+	root *patternMatchNode
+}
+
+type patternMatchNode struct {
+	interval    patternInterval
+	maxEnd      uint64
+	left, right *patternMatchNode
+}
+
+func newPatternMatchTree(patternMatches map[uint][]PatternSlice) *patternMatchTree {
+	intervals := make([]patternInterval, 0, InitialRegexSlicesCount)
+	for _, slices := range patternMatches {
+		for _, slice := range slices {
+			intervals = append(intervals, patternInterval{from: slice[0], to: slice[1]})
+		}
+	}
+	sortIntervalsByFrom(intervals)
+	return &patternMatchTree{root: buildPatternMatchNode(intervals)}
+}
+
+func sortIntervalsByFrom(intervals []patternInterval) {
+	// insertion sort: connections carry at most a few thousand pattern matches, so an allocation-free O(N^2)
+	// worst case here is cheaper in practice than pulling in sort.Slice's reflection-based comparator.
+	for i := 1; i < len(intervals); i++ {
+		for j := i; j > 0 && intervals[j-1].from > intervals[j].from; j-- {
+			intervals[j-1], intervals[j] = intervals[j], intervals[j-1]
+		}
+	}
+}
+
+func buildPatternMatchNode(intervals []patternInterval) *patternMatchNode {
+	if len(intervals) == 0 {
+		return nil
+	}
+	mid := len(intervals) / 2
+	node := &patternMatchNode{
+		interval: intervals[mid],
+		maxEnd:   intervals[mid].to,
+		left:     buildPatternMatchNode(intervals[:mid]),
+		right:    buildPatternMatchNode(intervals[mid+1:]),
+	}
+	if node.left != nil && node.left.maxEnd > node.maxEnd {
+		node.maxEnd = node.left.maxEnd
+	}
+	if node.right != nil && node.right.maxEnd > node.maxEnd {
+		node.maxEnd = node.right.maxEnd
+	}
+	return node
+}
+
+// query returns every interval overlapping [from, to), matching the boundary semantics of the linear scan this
+// tree replaces: a match ending exactly at from (from == interval.to) is still kept, so the test is
+// from <= interval.to && to > interval.from.
+func (t *patternMatchTree) query(from, to uint64) []patternInterval {
+	var matches []patternInterval
+	var visit func(n *patternMatchNode)
+	visit = func(n *patternMatchNode) {
+		if n == nil || n.maxEnd < from {
+			return
+		}
+		visit(n.left)
+		if from <= n.interval.to && to > n.interval.from {
+			matches = append(matches, n.interval)
+		}
+		if n.interval.from < to {
+			visit(n.right)
+		}
+	}
+	visit(t.root)
+	return matches
+}
+
+// patternMatchTreeCacheCapacity must hold at least 2 entries (client + server stream) for every walk in flight
+// at once, not just one: GetConnectionPayload/GetConnectionPayloadRange/StreamConnectionPayload can all be
+// serving different connections (or different ranges of the same one) concurrently, each walking through
+// iterateConnectionPayloadFrom/findMatchesBetween. A capacity of 4 only covered a single walk, so with more than
+// ~2 concurrent views the LRU evicted entries a still-running walk needed, forcing a rebuild of the tree (O(N))
+// on the very next call and defeating the O(log N) goal this cache exists for. Sized for a realistic number of
+// simultaneous connection views rather than the minimum one.
+const patternMatchTreeCacheCapacity = 64
+
+// patternMatchTreeCache caches one patternMatchTree per ConnectionStream.ID, built lazily on first use. Each
+// document_index is a separate ConnectionStream with its own ID and so gets its own tree; the tree of a document
+// that has been fully consumed is not dropped when the next one is fetched, it stays cached until it is the least
+// recently used entry of a full cache.
+type patternMatchTreeCache struct {
+	mu    sync.Mutex
+	order []RowID
+	byID  map[RowID]*patternMatchTree
+}
+
+var globalPatternMatchTreeCache = &patternMatchTreeCache{byID: make(map[RowID]*patternMatchTree)}
+
+func (c *patternMatchTreeCache) get(streamID RowID, patternMatches map[uint][]PatternSlice) *patternMatchTree {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if tree, ok := c.byID[streamID]; ok {
+		for i, id := range c.order {
+			if id == streamID {
+				c.order = append(append(c.order[:i], c.order[i+1:]...), streamID)
+				break
+			}
+		}
+		return tree
+	}
+
+	if len(c.order) >= patternMatchTreeCacheCapacity {
+		delete(c.byID, c.order[0])
+		c.order = c.order[1:]
+	}
+	tree := newPatternMatchTree(patternMatches)
+	c.byID[streamID] = tree
+	c.order = append(c.order, streamID)
+	return tree
+}
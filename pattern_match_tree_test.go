@@ -0,0 +1,48 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// TestPatternMatchTreeQueryBoundarySemantics pins down the inclusive/exclusive boundary semantics query documents
+// it must preserve from the linear scan it replaces (see commit 0666173, which had to fix a regression here): a
+// match ending exactly at from is kept, a match starting exactly at to is not.
+func TestPatternMatchTreeQueryBoundarySemantics(t *testing.T) {
+	patternMatches := map[uint][]PatternSlice{
+		0: {{10, 20}, {20, 30}, {40, 50}},
+		1: {{5, 10}},
+	}
+	tree := newPatternMatchTree(patternMatches)
+
+	tests := []struct {
+		name     string
+		from, to uint64
+		want     []patternInterval
+	}{
+		{"exact match", 10, 20, []patternInterval{{5, 10}, {10, 20}}},
+		{"query starting at a match's end still keeps it", 20, 25, []patternInterval{{10, 20}, {20, 30}}},
+		{"empty range before any interval", 0, 5, nil},
+		{"half-open end excludes a match starting at to", 5, 10, []patternInterval{{5, 10}}},
+		{"query ending exactly at a match's start excludes it", 30, 40, []patternInterval{{20, 30}}},
+		{"spans every interval", 0, 100, []patternInterval{{5, 10}, {10, 20}, {20, 30}, {40, 50}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tree.query(tt.from, tt.to)
+			sort.Slice(got, func(i, j int) bool { return got[i].from < got[j].from })
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("query(%d, %d) = %v, want %v", tt.from, tt.to, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPatternMatchTreeQueryEmptyTree(t *testing.T) {
+	tree := newPatternMatchTree(nil)
+	if got := tree.query(0, 1000); got != nil {
+		t.Errorf("query on an empty tree = %v, want nil", got)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/jaeger"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/zipkin"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer is the package-wide tracer used to instrument the payload pipeline (ConnectionStreamsController and the
+// dissector subsystem). It defaults to the global no-op tracer until InitTracing installs a real provider, so the
+// instrumentation below is always safe to call even when tracing isn't configured.
+var tracer = otel.Tracer("caronte/connection_streams")
+
+// TracingConfig selects and configures the trace exporter. Exporter is one of "otlp", "jaeger", "zipkin" or ""
+// (tracing disabled).
+type TracingConfig struct {
+	Exporter    string `yaml:"exporter"`
+	Endpoint    string `yaml:"endpoint"`
+	ServiceName string `yaml:"service_name"`
+}
+
+// InitTracing builds the configured trace exporter, registers it as the global tracer provider and returns a
+// shutdown function that must be called (typically deferred) to flush pending spans before the process exits.
+// An empty Exporter disables tracing and returns a no-op shutdown function.
+func InitTracing(c context.Context, config TracingConfig) (func(context.Context) error, error) {
+	if config.Exporter == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch config.Exporter {
+	case "otlp":
+		exporter, err = otlptracegrpc.New(c, otlptracegrpc.WithEndpoint(config.Endpoint), otlptracegrpc.WithInsecure())
+	case "jaeger":
+		exporter, err = jaeger.New(jaeger.WithCollectorEndpoint(jaeger.WithEndpoint(config.Endpoint)))
+	case "zipkin":
+		exporter, err = zipkin.New(config.Endpoint)
+	default:
+		return nil, fmt.Errorf("unsupported tracing exporter: %s", config.Exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s exporter: %w", config.Exporter, err)
+	}
+
+	serviceName := config.ServiceName
+	if serviceName == "" {
+		serviceName = "caronte"
+	}
+	res, err := resource.Merge(resource.Default(),
+		resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(serviceName)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build tracing resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	tracer = provider.Tracer("caronte/connection_streams")
+
+	return provider.Shutdown, nil
+}
+
+// recordSpanError marks a span as failed and attaches the error, without altering the caller's own error
+// handling (e.g. the existing log.Panic on a Mongo error).
+func recordSpanError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}